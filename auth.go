@@ -0,0 +1,106 @@
+package couchbase
+
+import (
+	"sync"
+	"time"
+)
+
+// refreshableAuthHandler is implemented by AuthHandlers whose cached
+// credentials can be invalidated after the server rejects them, so the
+// next call to GetCredentials/GetSaslCredentials fetches a fresh pair.
+// parseURLResponse uses this to retry once after a 401.
+type refreshableAuthHandler interface {
+	forceRefresh()
+}
+
+// SaslAuthHandler is implemented by AuthHandlers that can hand out
+// different SASL credentials per memcached node and bucket, instead of
+// the single pair GetCredentials returns for everything. It's optional
+// and checked for via a type assertion, so existing AuthHandler
+// implementations keep compiling unchanged if they don't implement it.
+type SaslAuthHandler interface {
+	AuthHandler
+	GetSaslCredentials(host, bucket string) (user, pass string, err error)
+}
+
+// saslAuthAdapter is what actually wires SaslAuthHandler into
+// connection-pool construction: it's the AuthHandler a connectionPool
+// is given, so every time it dials a new memcached connection and asks
+// for credentials, a SaslAuthHandler gets to hand out credentials
+// specific to this host and bucket rather than whatever GetCredentials
+// returns for every node.
+type saslAuthAdapter struct {
+	ah     AuthHandler
+	host   string
+	bucket string
+}
+
+func (a saslAuthAdapter) GetCredentials() (string, string) {
+	if sah, ok := a.ah.(SaslAuthHandler); ok {
+		if user, pass, err := sah.GetSaslCredentials(a.host, a.bucket); err == nil {
+			return user, pass
+		}
+	}
+	return a.ah.GetCredentials()
+}
+
+// RefreshingAuthHandler is an AuthHandler backed by a caller-supplied
+// callback that fetches credentials good for a bounded amount of time,
+// e.g. from an external secret manager. Credentials are cached until
+// their TTL expires and refreshed transparently after that, without
+// requiring the cluster client to be reconnected.
+type RefreshingAuthHandler struct {
+	fetch func() (user, pass string, ttl time.Duration, err error)
+
+	mu     sync.Mutex
+	user   string
+	pass   string
+	expiry time.Time
+}
+
+// NewRefreshingAuthHandler returns an AuthHandler that calls fetch to
+// obtain a (user, pass) pair good for the returned ttl, re-calling it
+// once the ttl has elapsed or after the server rejects the cached
+// credentials with a 401.
+func NewRefreshingAuthHandler(fetch func() (user, pass string, ttl time.Duration, err error)) *RefreshingAuthHandler {
+	return &RefreshingAuthHandler{fetch: fetch}
+}
+
+func (r *RefreshingAuthHandler) credentials() (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Now().Before(r.expiry) {
+		return r.user, r.pass, nil
+	}
+
+	user, pass, ttl, err := r.fetch()
+	if err != nil {
+		// Keep serving the last known-good credentials; the caller
+		// gets a chance to force a refresh (e.g. after a 401) rather
+		// than being stuck on a transient secret-manager failure.
+		return r.user, r.pass, err
+	}
+	r.user, r.pass = user, pass
+	r.expiry = time.Now().Add(ttl)
+	return r.user, r.pass, nil
+}
+
+// GetCredentials implements AuthHandler.
+func (r *RefreshingAuthHandler) GetCredentials() (string, string) {
+	user, pass, _ := r.credentials()
+	return user, pass
+}
+
+// GetSaslCredentials implements SaslAuthHandler.
+func (r *RefreshingAuthHandler) GetSaslCredentials(host, bucket string) (string, string, error) {
+	return r.credentials()
+}
+
+// forceRefresh discards any cached credentials, so the next call to
+// GetCredentials/GetSaslCredentials invokes fetch again.
+func (r *RefreshingAuthHandler) forceRefresh() {
+	r.mu.Lock()
+	r.expiry = time.Time{}
+	r.mu.Unlock()
+}
@@ -0,0 +1,55 @@
+package couchbase
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshingAuthHandlerCredentials(t *testing.T) {
+	calls := 0
+	ah := NewRefreshingAuthHandler(func() (string, string, time.Duration, error) {
+		calls++
+		return "user", "pass", 50 * time.Millisecond, nil
+	})
+
+	u, p := ah.GetCredentials()
+	if u != "user" || p != "pass" {
+		t.Fatalf("GetCredentials() = %q, %q", u, p)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 fetch, got %d", calls)
+	}
+
+	// Cached credentials are reused until the TTL expires.
+	ah.GetCredentials()
+	if calls != 1 {
+		t.Fatalf("expected cached credentials to avoid a second fetch, got %d calls", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	ah.GetCredentials()
+	if calls != 2 {
+		t.Fatalf("expected credentials to be refreshed after the ttl elapsed, got %d calls", calls)
+	}
+
+	// forceRefresh invalidates the cache immediately, regardless of ttl.
+	ah.forceRefresh()
+	ah.GetCredentials()
+	if calls != 3 {
+		t.Fatalf("expected forceRefresh to force a fetch, got %d calls", calls)
+	}
+}
+
+func TestRefreshingAuthHandlerSaslCredentials(t *testing.T) {
+	ah := NewRefreshingAuthHandler(func() (string, string, time.Duration, error) {
+		return "user", "pass", time.Minute, nil
+	})
+
+	u, p, err := ah.GetSaslCredentials("host1:11210", "bucketA")
+	if err != nil {
+		t.Fatalf("GetSaslCredentials returned error: %v", err)
+	}
+	if u != "user" || p != "pass" {
+		t.Fatalf("GetSaslCredentials() = %q, %q", u, p)
+	}
+}
@@ -0,0 +1,84 @@
+package couchbase
+
+import "sync"
+
+// defaultPoolSize is used when ClientOptions.PoolSize is unset.
+const defaultPoolSize = 4
+
+// connectionManager hands out connectionPools shared across the
+// Buckets obtained from the same Client, keyed by (host, bucket).
+// Every Bucket value for the same bucket name shares one pool per
+// memcached node instead of opening its own. Keying on the bucket name
+// too, rather than host alone, keeps buckets with distinct SASL
+// credentials from ending up sharing a connection authenticated as
+// whichever bucket acquired it first; buckets with different names
+// therefore never share a pool, even on the same host.
+type connectionManager struct {
+	mu       sync.Mutex
+	poolSize int
+	pools    map[poolKey]*sharedPool
+}
+
+// poolKey identifies a shared connectionPool: one memcached host,
+// authenticated for one bucket.
+type poolKey struct {
+	host   string
+	bucket string
+}
+
+// sharedPool is a connectionPool plus the count of buckets currently
+// holding a reference to it.
+type sharedPool struct {
+	pool     *connectionPool
+	refCount int
+}
+
+func newConnectionManager(poolSize int) *connectionManager {
+	if poolSize <= 0 {
+		poolSize = defaultPoolSize
+	}
+	return &connectionManager{
+		poolSize: poolSize,
+		pools:    make(map[poolKey]*sharedPool),
+	}
+}
+
+// acquire returns the connectionPool shared by every bucket named
+// bucket talking to host, opening it (with ah as its auth handler) if
+// this is the first reference. Each call to acquire must be balanced
+// by a call to release.
+func (m *connectionManager) acquire(host, bucket string, ah AuthHandler) *connectionPool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := poolKey{host, bucket}
+	sp, ok := m.pools[key]
+	if !ok {
+		// saslAuthAdapter lets ah hand out per-(host, bucket) SASL
+		// credentials, if it implements SaslAuthHandler, every time
+		// this pool dials a new memcached connection.
+		adapted := saslAuthAdapter{ah: ah, host: host, bucket: bucket}
+		sp = &sharedPool{pool: newConnectionPool(host, bucket, adapted, m.poolSize)}
+		m.pools[key] = sp
+	}
+	sp.refCount++
+	return sp.pool
+}
+
+// release drops a reference to the pool for (host, bucket), closing and
+// removing it once the last bucket using it has released.
+func (m *connectionManager) release(host, bucket string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := poolKey{host, bucket}
+	sp, ok := m.pools[key]
+	if !ok {
+		return
+	}
+	sp.refCount--
+	if sp.refCount <= 0 {
+		sp.pool.Close()
+		delete(m.pools, key)
+	}
+}
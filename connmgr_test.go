@@ -0,0 +1,35 @@
+package couchbase
+
+import "testing"
+
+func TestConnectionManagerRefcounting(t *testing.T) {
+	mgr := newConnectionManager(1)
+	ah := basicAuth{"user", "pass"}
+
+	p1 := mgr.acquire("host1:11210", "bucketA", ah)
+	p2 := mgr.acquire("host1:11210", "bucketA", ah)
+	if p1 != p2 {
+		t.Fatalf("expected acquiring the same (host, bucket) twice to return the same pool")
+	}
+
+	p3 := mgr.acquire("host1:11210", "bucketB", ah)
+	if p3 == p1 {
+		t.Fatalf("expected a different bucket on the same host to get a distinct pool")
+	}
+
+	mgr.release("host1:11210", "bucketA")
+	mgr.mu.Lock()
+	_, stillTracked := mgr.pools[poolKey{"host1:11210", "bucketA"}]
+	mgr.mu.Unlock()
+	if !stillTracked {
+		t.Fatalf("expected pool to remain while a reference is still held")
+	}
+
+	mgr.release("host1:11210", "bucketA")
+	mgr.mu.Lock()
+	_, stillTracked = mgr.pools[poolKey{"host1:11210", "bucketA"}]
+	mgr.mu.Unlock()
+	if stillTracked {
+		t.Fatalf("expected pool to be removed once its last reference is released")
+	}
+}
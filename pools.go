@@ -100,6 +100,13 @@ type Bucket struct {
 	connections []*connectionPool
 	commonSufix string
 	lock        sync.RWMutex
+
+	topologyCh chan struct{} // notified (coalesced) whenever the topology below changes
+	streamQuit chan bool     // closed to stop the config-streaming goroutine
+
+	retryPolicy    RetryPolicy
+	refreshCh      chan struct{} // non-nil while a coalesced refresh is in flight
+	lastRefreshErr error
 }
 
 func (b Bucket) authHandler() (ah AuthHandler) {
@@ -135,6 +142,8 @@ type Client struct {
 	ah       AuthHandler
 	Info     Pools
 	Statuses [256]uint64
+
+	connMgr *connectionManager
 }
 
 func maybeAddAuth(req *http.Request, ah AuthHandler) {
@@ -146,6 +155,15 @@ func maybeAddAuth(req *http.Request, ah AuthHandler) {
 }
 
 func (c *Client) parseURLResponse(path string, out interface{}) error {
+	return c.parseURLResponseRetry(path, out, true)
+}
+
+// parseURLResponseRetry is parseURLResponse with control over whether a
+// 401 response gets one retry after asking c.ah to refresh its
+// credentials. Call sites should go through parseURLResponse; the
+// retry itself calls back in with allowRetry set to false so a
+// still-stale credential can't loop forever.
+func (c *Client) parseURLResponseRetry(path string, out interface{}, allowRetry bool) error {
 	u := *c.BaseURL
 	u.User = nil
 	if q := strings.Index(path, "?"); q > 0 {
@@ -166,6 +184,13 @@ func (c *Client) parseURLResponse(path string, out interface{}) error {
 		return err
 	}
 	defer res.Body.Close()
+
+	if res.StatusCode == 401 && allowRetry {
+		if rah, ok := c.ah.(refreshableAuthHandler); ok {
+			rah.forceRefresh()
+			return c.parseURLResponseRetry(path, out, false)
+		}
+	}
 	if res.StatusCode != 200 {
 		bod, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
 		return fmt.Errorf("HTTP error %v getting %q: %s",
@@ -179,6 +204,49 @@ func (c *Client) parseURLResponse(path string, out interface{}) error {
 	return nil
 }
 
+// streamURLResponse opens a chunked (multi-document) HTTP response and
+// hands the body to cb, which is expected to keep reading from it until
+// the connection is closed or an error occurs. It returns once cb
+// returns or quit is closed, whichever comes first.
+func (c *Client) streamURLResponse(path string, quit <-chan bool, cb func(io.Reader) error) error {
+	u := *c.BaseURL
+	u.User = nil
+	if q := strings.Index(path, "?"); q > 0 {
+		u.Path = path[:q]
+		u.RawQuery = path[q+1:]
+	} else {
+		u.Path = path
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	maybeAddAuth(req, c.ah)
+
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		bod, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("HTTP error %v getting %q: %s",
+			res.Status, u.String(), bod)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cb(res.Body) }()
+	select {
+	case err := <-done:
+		return err
+	case <-quit:
+		res.Body.Close()
+		<-done
+		return nil
+	}
+}
+
 type basicAuth struct {
 	u, p string
 }
@@ -187,6 +255,10 @@ func (b basicAuth) GetCredentials() (string, string) {
 	return b.u, b.p
 }
 
+func (b basicAuth) GetSaslCredentials(host, bucket string) (string, string, error) {
+	return b.u, b.p, nil
+}
+
 func basicAuthFromURL(us string) (ah AuthHandler) {
 	u, err := url.Parse(us)
 	if err != nil {
@@ -199,18 +271,36 @@ func basicAuthFromURL(us string) (ah AuthHandler) {
 	return
 }
 
-// ConnectWithAuth connects to a couchbase cluster with the given
-// authentication handler.
-func ConnectWithAuth(baseU string, ah AuthHandler) (c Client, err error) {
+// ClientOptions configures optional Client behavior beyond what
+// ConnectWithAuth needs.
+type ClientOptions struct {
+	// PoolSize caps how many concurrent memcached connections each
+	// shared connection pool may open. There is one pool per (host,
+	// bucket name): every Bucket obtained for the same bucket name
+	// shares it, while buckets with different names each get their own
+	// pool per host. Defaults to 4 if zero.
+	PoolSize int
+}
+
+// ConnectWithAuthOptions is ConnectWithAuth with control over the
+// shared connection pool's behavior via options.
+func ConnectWithAuthOptions(baseU string, ah AuthHandler, options ClientOptions) (c Client, err error) {
 	c.BaseURL, err = url.Parse(baseU)
 	if err != nil {
 		return
 	}
 	c.ah = ah
+	c.connMgr = newConnectionManager(options.PoolSize)
 
 	return c, c.parseURLResponse("/pools", &c.Info)
 }
 
+// ConnectWithAuth connects to a couchbase cluster with the given
+// authentication handler.
+func ConnectWithAuth(baseU string, ah AuthHandler) (c Client, err error) {
+	return ConnectWithAuthOptions(baseU, ah, ClientOptions{})
+}
+
 // Connect to a couchbase cluster.  An authentication handler will be
 // created from the userinfo in the URL if provided.
 func Connect(baseU string) (Client, error) {
@@ -228,6 +318,18 @@ func (b *Bucket) getConnectionPool(key string) (*connectionPool, uint16) {
 	return b.connections[masterId], uint16(vb)
 }
 
+// masterPoolForVBucket returns the connection pool for the node that
+// currently owns vb, or nil if the vbucket map doesn't cover it.
+func (b *Bucket) masterPoolForVBucket(vb uint16) *connectionPool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if int(vb) >= len(b.VBucketServerMap.VBucketMap) || len(b.VBucketServerMap.VBucketMap[vb]) < 1 {
+		return nil
+	}
+	masterId := b.VBucketServerMap.VBucketMap[vb][0]
+	return b.connections[masterId]
+}
+
 func (b *Bucket) refresh() (err error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -239,27 +341,37 @@ func (b *Bucket) refresh() (err error) {
 	}
 	b.pool = pool
 
+	b.rebuildConnectionsLocked()
+	return nil
+}
+
+// rebuildConnectionsLocked reconciles b.connections with the current
+// VBucketServerMap.ServerList, preserving connection pools that are
+// still in use, releasing ones that departed, and acquiring new ones
+// from the Client's shared connectionManager. b.lock must be held for
+// writing.
+func (b *Bucket) rebuildConnectionsLocked() {
+	mgr := b.pool.client.connMgr
+
 	// build map of desired connections
 	conns := make(map[string]*connectionPool)
 	for _, host := range b.VBucketServerMap.ServerList {
 		conns[host] = nil
 	}
 
-	// preserve existing connections, and close departing connections
+	// preserve existing connections, and release departing connections
 	for _, cp := range b.connections {
 		if _, ok := conns[cp.host]; ok {
 			conns[cp.host] = cp
 		} else {
-			cp.Close()
+			mgr.release(cp.host, b.Name)
 		}
 	}
 
-	// craete new connection pools
+	// acquire a shared pool for every newly-needed host
 	for host, cp := range conns {
 		if cp == nil {
-			conns[host] = newConnectionPool(
-				host,
-				b.authHandler(), 4)
+			conns[host] = mgr.acquire(host, b.Name, b.authHandler())
 		}
 	}
 
@@ -272,7 +384,12 @@ func (b *Bucket) refresh() (err error) {
 		b.connections[ii] = conns[host]
 	}
 
-	return nil
+	if b.topologyCh != nil {
+		select {
+		case b.topologyCh <- struct{}{}:
+		default:
+		}
+	}
 }
 
 func (p *Pool) refresh() (err error) {
@@ -310,12 +427,32 @@ func (c *Client) GetPool(name string) (p Pool, err error) {
 	return
 }
 
+// TopologyChanges returns a channel that receives a notification
+// whenever the bucket's node list or vbucket map changes, e.g. due to
+// a rebalance or failover observed on the streaming config endpoint.
+// Notifications are coalesced, so a receiver only needs to re-read the
+// bucket's current topology rather than queue up every change.
+func (b *Bucket) TopologyChanges() <-chan struct{} {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.topologyCh
+}
+
 // Mark this bucket as no longer needed, closing connections it may have open.
+// Shared connection pools are released; each is closed only once no other Bucket holds it.
 func (b *Bucket) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.streamQuit != nil {
+		close(b.streamQuit)
+		b.streamQuit = nil
+	}
 	if b.connections != nil {
+		mgr := b.pool.client.connMgr
 		for _, c := range b.connections {
 			if c != nil {
-				c.Close()
+				mgr.release(c.host, b.Name)
 			}
 		}
 		b.connections = nil
@@ -339,6 +476,12 @@ func (p *Pool) GetBucket(name string) (*Bucket, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	rv.topologyCh = make(chan struct{}, 1)
+	rv.streamQuit = make(chan bool)
+	rv.retryPolicy = DefaultRetryPolicy
+	go rv.runConfigStream(rv.streamQuit)
+
 	return &rv, nil
 }
 
@@ -0,0 +1,118 @@
+package couchbase
+
+import (
+	"log"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// RetryPolicy controls how ops run through Bucket.Do retry after the
+// server responds NOT_MY_VBUCKET, i.e. this node is no longer the
+// master for the op's vbucket.
+type RetryPolicy struct {
+	// MaxRetries bounds how many times an op is retried against the
+	// new master. Zero disables automatic retry.
+	MaxRetries int
+
+	// InitialInterval and MaximumInterval bound the exponential
+	// backoff between retries. Zero selects the package defaults
+	// (initialRetryInterval / maximumRetryInterval).
+	InitialInterval time.Duration
+	MaximumInterval time.Duration
+}
+
+// DefaultRetryPolicy retries a handful of times, backing off with the
+// same bounds TapFeed and UprFeed use when reconnecting.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:      3,
+	InitialInterval: initialRetryInterval,
+	MaximumInterval: maximumRetryInterval,
+}
+
+// SetRetryPolicy installs the policy used by ops run through Bucket.Do
+// after a NOT_MY_VBUCKET response. Pass the zero RetryPolicy to disable
+// automatic retry.
+func (b *Bucket) SetRetryPolicy(policy RetryPolicy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.retryPolicy = policy
+}
+
+// Do runs op against the memcached connection that currently owns
+// key's vbucket. If the server responds NOT_MY_VBUCKET, Do refreshes
+// the bucket's topology (coalesced across concurrent callers), recomputes
+// the master, and retries against it up to the installed RetryPolicy.
+func (b *Bucket) Do(key string, op func(cp *connectionPool, vb uint16) error) error {
+	b.lock.RLock()
+	policy := b.retryPolicy
+	b.lock.RUnlock()
+
+	cp, vb := b.getConnectionPool(key)
+	err := op(cp, vb)
+
+	for attempt := 0; isNotMyVBucket(err) && attempt < policy.MaxRetries; attempt++ {
+		if refreshErr := b.coalescedRefresh(); refreshErr != nil {
+			log.Printf("go-couchbase: refresh of bucket %q after NOT_MY_VBUCKET failed: %v",
+				b.Name, refreshErr)
+			return err
+		}
+
+		time.Sleep(retryBackoff(policy, attempt))
+
+		cp, vb = b.getConnectionPool(key)
+		err = op(cp, vb)
+	}
+	return err
+}
+
+func isNotMyVBucket(err error) bool {
+	res, ok := err.(*gomemcached.MCResponse)
+	return ok && res.Status == gomemcached.NOT_MY_VBUCKET
+}
+
+func retryBackoff(policy RetryPolicy, attempt int) time.Duration {
+	initial := policy.InitialInterval
+	if initial <= 0 {
+		initial = initialRetryInterval
+	}
+	max := policy.MaximumInterval
+	if max <= 0 {
+		max = maximumRetryInterval
+	}
+
+	d := initial
+	for i := 0; i < attempt; i++ {
+		if d *= 2; d > max {
+			return max
+		}
+	}
+	return d
+}
+
+// coalescedRefresh ensures concurrent callers triggering a refresh (for
+// example, several ops hitting NOT_MY_VBUCKET at the same time) share a
+// single in-flight Bucket.refresh call instead of each issuing their own.
+func (b *Bucket) coalescedRefresh() error {
+	b.lock.Lock()
+	if ch := b.refreshCh; ch != nil {
+		b.lock.Unlock()
+		<-ch
+		b.lock.RLock()
+		err := b.lastRefreshErr
+		b.lock.RUnlock()
+		return err
+	}
+	ch := make(chan struct{})
+	b.refreshCh = ch
+	b.lock.Unlock()
+
+	err := b.refresh()
+
+	b.lock.Lock()
+	b.lastRefreshErr = err
+	b.refreshCh = nil
+	b.lock.Unlock()
+	close(ch)
+	return err
+}
@@ -0,0 +1,36 @@
+package couchbase
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxRetries:      5,
+		InitialInterval: 100 * time.Millisecond,
+		MaximumInterval: 500 * time.Millisecond,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 500 * time.Millisecond}, // capped
+		{4, 500 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if got := retryBackoff(policy, c.attempt); got != c.want {
+			t.Errorf("retryBackoff(attempt=%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryBackoffDefaults(t *testing.T) {
+	if got := retryBackoff(RetryPolicy{}, 0); got != initialRetryInterval {
+		t.Errorf("retryBackoff with zero policy = %v, want %v", got, initialRetryInterval)
+	}
+}
@@ -0,0 +1,94 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// runConfigStream keeps a long-lived connection to the bucket's chunked
+// streamingUri open, applying each new revision of the bucket config as
+// soon as it arrives. This lets TAP/UPR feeds and user code react to a
+// rebalance or failover immediately instead of after the next failed
+// op, which is all Bucket.refresh gives you on its own.
+//
+// quit is the bucket's streamQuit channel as it was when this goroutine
+// was started; it's passed in rather than re-read from b.streamQuit on
+// every iteration because Close() sets that field to nil once closed,
+// which would otherwise turn every subsequent select on it into a
+// permanently-blocking nil-channel read.
+func (b *Bucket) runConfigStream(quit chan bool) {
+	retryInterval := initialRetryInterval
+	for {
+		err := b.streamConfig(quit, func() {
+			// The stream connected successfully; a subsequent drop is
+			// a fresh failure, not a continuation of earlier ones, so
+			// don't let it inherit backoff ratcheted up by any
+			// previous reconnect attempts.
+			retryInterval = initialRetryInterval
+		})
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("go-couchbase: config stream for bucket %q failed: %v; reconnecting in %v",
+				b.Name, err, retryInterval)
+		}
+
+		select {
+		case <-time.After(withJitter(retryInterval)):
+		case <-quit:
+			return
+		}
+		if retryInterval *= 2; retryInterval > maximumRetryInterval {
+			retryInterval = maximumRetryInterval
+		}
+	}
+}
+
+// streamConfig opens the streaming endpoint and decodes chunks from it
+// until the connection drops or quit is closed. onConnected is called
+// once the connection is established, before the first chunk is read.
+func (b *Bucket) streamConfig(quit chan bool, onConnected func()) error {
+	b.lock.RLock()
+	pool := b.pool
+	uri := b.StreamingURI
+	b.lock.RUnlock()
+
+	return pool.client.streamURLResponse(uri, quit, func(r io.Reader) error {
+		onConnected()
+		dec := json.NewDecoder(r)
+		for {
+			var next Bucket
+			if err := dec.Decode(&next); err != nil {
+				return err
+			}
+			b.applyTopology(&next)
+		}
+	})
+}
+
+// applyTopology swaps in the node list and vbucket map from next and
+// reconciles the connection pool accordingly.
+func (b *Bucket) applyTopology(next *Bucket) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.Nodes = next.Nodes
+	b.VBucketServerMap = next.VBucketServerMap
+
+	b.rebuildConnectionsLocked()
+}
+
+// withJitter returns a duration randomized within [d/2, 3d/2), so that
+// many clients reconnecting to the same node after an outage don't do
+// so in lockstep.
+func withJitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
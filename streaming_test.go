@@ -0,0 +1,16 @@
+package couchbase
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithJitter(t *testing.T) {
+	d := 10 * time.Second
+	for i := 0; i < 1000; i++ {
+		got := withJitter(d)
+		if got < d/2 || got >= d/2+d {
+			t.Fatalf("withJitter(%v) = %v, want a value in [%v, %v)", d, got, d/2, d/2+d)
+		}
+	}
+}
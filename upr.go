@@ -0,0 +1,298 @@
+package couchbase
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached/client"
+)
+
+// UprFeed streams mutation events from a bucket using the DCP (UPR)
+// protocol, the successor to TAP.
+//
+// Events from the bucket can be read from the channel 'C'.  Remember
+// to call Close() on it when you're done, unless its channel has
+// closed itself already.
+type UprFeed struct {
+	C <-chan memcached.UprEvent
+
+	bucket     *Bucket
+	name       string
+	sequence   uint32
+	args       *UprArguments
+	nodeFeeds  map[string]*memcached.UprFeed // The UPR feeds of the individual nodes, keyed by host
+	output     chan memcached.UprEvent       // Same as C but writeably-typed
+	quit       chan bool
+	killSwitch chan error      // shared by every node feed of the current connection cycle
+	wg         *sync.WaitGroup // tracks the forwarder goroutines of the current connection cycle
+
+	mutex  sync.Mutex        // guards nodeFeeds and vbSeqs
+	vbSeqs map[uint16]uint32 // last sequence number observed per vbucket, for resuming after a handoff
+}
+
+// UprArguments are the parameters used to open a DCP/UPR stream.
+type UprArguments struct {
+	// NoRollback disables transparent rollback handling; instead of
+	// retrying with the server-suggested sequence number, the rollback
+	// is surfaced on the event channel as a memcached.UprEvent.
+	NoRollback bool
+}
+
+// StartUprFeed creates and starts a new DCP/UPR feed, streaming mutations
+// for every vbucket the bucket's nodes are responsible for, starting at
+// sequence.
+func (b *Bucket) StartUprFeed(name string, sequence uint32, args *UprArguments) (*UprFeed, error) {
+	if args == nil {
+		args = &UprArguments{}
+	}
+
+	feed := &UprFeed{
+		bucket:   b,
+		name:     name,
+		sequence: sequence,
+		args:     args,
+		output:   make(chan memcached.UprEvent, 10),
+		quit:     make(chan bool),
+	}
+
+	go feed.run()
+
+	feed.C = feed.output
+	return feed, nil
+}
+
+// Goroutine that runs the feed
+func (feed *UprFeed) run() {
+	retryInterval := initialRetryInterval
+	bucketOK := true
+	for {
+		// Connect to the UPR feed of each server node:
+		var feedErr error
+		if bucketOK {
+			killSwitch, err := feed.connectToNodes()
+			if err == nil {
+				// Run until one of the sub-feeds fails:
+				select {
+				case feedErr = <-killSwitch:
+					if feedErr == nil {
+						feed.Close()
+						return
+					}
+				case <-feed.quit:
+					return
+				}
+				feed.closeNodeFeeds()
+				retryInterval = initialRetryInterval
+			}
+		}
+
+		// On error, try to refresh the bucket in case the list of nodes changed:
+		log.Printf("go-couchbase: UPR connection lost %v; reconnecting to bucket %q in %v",
+			feedErr, feed.bucket.Name, retryInterval)
+		err := feed.bucket.refresh()
+		bucketOK = err == nil
+		if !bucketOK {
+			log.Printf("go-couchbase: refresh of bucket %v failed: %v",
+				feed.bucket.Name, err)
+		}
+
+		select {
+		case <-time.After(retryInterval):
+		case <-feed.quit:
+			return
+		}
+		if retryInterval *= 2; retryInterval > maximumRetryInterval {
+			retryInterval = maximumRetryInterval
+		}
+	}
+}
+
+func (feed *UprFeed) connectToNodes() (killSwitch chan error, err error) {
+	wg := &sync.WaitGroup{}
+	pools := feed.bucket.getConnPools()
+	killSwitch = make(chan error, len(pools))
+
+	feed.mutex.Lock()
+	feed.nodeFeeds = make(map[string]*memcached.UprFeed, len(pools))
+	feed.mutex.Unlock()
+
+	feed.killSwitch = killSwitch
+	feed.wg = wg
+
+	for _, serverConn := range pools {
+		if err = feed.openNodeFeed(serverConn, wg); err != nil {
+			feed.closeNodeFeeds()
+			return
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(feed.output)
+	}()
+	return
+}
+
+// openNodeFeed opens the UPR stream against a single node and starts
+// forwarding its events into the aggregate feed. It can be called both
+// while assembling the initial set of node feeds and later, to connect
+// to a node handleNotMyVBucket discovers is a new master the feed
+// hasn't talked to yet.
+func (feed *UprFeed) openNodeFeed(serverConn *connectionPool, wg *sync.WaitGroup) error {
+	singleFeed, err := serverConn.StartUprFeed(feed.name, feed.sequence)
+	if err != nil {
+		log.Printf("go-couchbase: Error connecting to upr feed of %s: %v", serverConn.host, err)
+		return err
+	}
+
+	feed.mutex.Lock()
+	feed.nodeFeeds[serverConn.host] = singleFeed
+	feed.mutex.Unlock()
+
+	wg.Add(1)
+	go feed.forwardUprEvents(singleFeed, feed.killSwitch, serverConn.host, wg)
+	return nil
+}
+
+// Goroutine that forwards UPR events from a single node's feed to the
+// aggregate feed.  NOT_MY_VBUCKET responses are handled locally: the
+// bucket topology is refreshed and the affected stream is reopened
+// against its new master, rather than tearing the whole feed down.
+func (feed *UprFeed) forwardUprEvents(singleFeed *memcached.UprFeed, killSwitch chan error, host string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case event, ok := <-singleFeed.C:
+			if !ok {
+				if singleFeed.Error != nil {
+					log.Printf("go-couchbase: Upr feed from %s failed: %v", host, singleFeed.Error)
+				}
+				killSwitch <- singleFeed.Error
+				return
+			}
+			switch event.Opcode {
+			case memcached.UprStreamReq:
+				if event.Status == memcached.NOT_MY_VBUCKET {
+					feed.handleNotMyVBucket(host, event.VBucket, wg)
+					continue
+				}
+				if event.Status == memcached.ROLLBACK && !feed.args.NoRollback {
+					feed.handleRollback(singleFeed, event)
+					continue
+				}
+			case memcached.UprMutation, memcached.UprDeletion, memcached.UprExpiration:
+				feed.recordSequence(event.VBucket, event.Seqno)
+			case memcached.UprSnapshot:
+				// Snapshot markers are passed straight through so
+				// consumers can track checkpoint boundaries.
+			}
+			feed.output <- event
+		case <-feed.quit:
+			return
+		}
+	}
+}
+
+// recordSequence remembers the last sequence number seen for vb, so a
+// stream reopened after a NOT_MY_VBUCKET handoff can resume from there
+// instead of replaying from the feed's original start sequence.
+func (feed *UprFeed) recordSequence(vb uint16, seqno uint32) {
+	feed.mutex.Lock()
+	if feed.vbSeqs == nil {
+		feed.vbSeqs = make(map[uint16]uint32)
+	}
+	feed.vbSeqs[vb] = seqno
+	feed.mutex.Unlock()
+}
+
+// resumeSequence returns the sequence number to reopen vb's stream at:
+// the last one observed for it, or the feed's original start sequence
+// if none has been seen yet.
+func (feed *UprFeed) resumeSequence(vb uint16) uint32 {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if seq, ok := feed.vbSeqs[vb]; ok {
+		return seq
+	}
+	return feed.sequence
+}
+
+// handleNotMyVBucket refreshes the bucket's topology and reopens only
+// the stream whose vbucket ownership moved away from host, resuming
+// from the last sequence number observed for that vbucket rather than
+// restarting it from the beginning. If the new master is a node the
+// feed hasn't connected to yet (e.g. one added by the rebalance), it
+// opens a connection to it instead of abandoning the vbucket; that
+// node's feed starts at the feed's original start sequence, so in this
+// case vb is not resumed from its last observed sequence number.
+func (feed *UprFeed) handleNotMyVBucket(host string, vb uint16, wg *sync.WaitGroup) {
+	log.Printf("go-couchbase: %s is no longer master for vbucket %d; refreshing bucket %q",
+		host, vb, feed.bucket.Name)
+	if err := feed.bucket.coalescedRefresh(); err != nil {
+		log.Printf("go-couchbase: refresh of bucket %v failed: %v", feed.bucket.Name, err)
+		return
+	}
+
+	newConn := feed.bucket.masterPoolForVBucket(vb)
+	if newConn == nil || newConn.host == host {
+		// Topology didn't settle on a new master yet; vb's stream stays
+		// closed until run reconnects the whole feed after a node feed
+		// fails.
+		return
+	}
+
+	feed.mutex.Lock()
+	newFeed, ok := feed.nodeFeeds[newConn.host]
+	feed.mutex.Unlock()
+
+	if !ok {
+		// wg.Add here is safe even though wg.Wait is running
+		// concurrently in connectToNodes' closer goroutine: this
+		// call runs on the forwardUprEvents goroutine for host,
+		// which hasn't called wg.Done yet, so the group can't be
+		// observed at zero until after this Add has taken effect.
+		if err := feed.openNodeFeed(newConn, wg); err != nil {
+			log.Printf("go-couchbase: failed to connect to new master %s for vbucket %d: %v",
+				newConn.host, vb, err)
+		}
+		return
+	}
+
+	if err := newFeed.OpenStream(vb, feed.resumeSequence(vb)); err != nil {
+		log.Printf("go-couchbase: failed to reopen upr stream for vbucket %d on %s: %v", vb, newConn.host, err)
+	}
+}
+
+// handleRollback restarts a single vbucket's stream at the sequence
+// number the server requested.
+func (feed *UprFeed) handleRollback(singleFeed *memcached.UprFeed, event memcached.UprEvent) {
+	log.Printf("go-couchbase: upr stream for vbucket %d rolled back to sequence %d",
+		event.VBucket, event.RollbackSeq)
+	if err := singleFeed.OpenStream(event.VBucket, event.RollbackSeq); err != nil {
+		log.Printf("go-couchbase: failed to resume upr stream for vbucket %d after rollback: %v",
+			event.VBucket, err)
+	}
+}
+
+func (feed *UprFeed) closeNodeFeeds() {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	for _, f := range feed.nodeFeeds {
+		f.Close()
+	}
+	feed.nodeFeeds = nil
+}
+
+// Close a UPR feed.
+func (feed *UprFeed) Close() error {
+	select {
+	case <-feed.quit:
+		return nil
+	default:
+	}
+
+	feed.closeNodeFeeds()
+	close(feed.quit)
+	return nil
+}